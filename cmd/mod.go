@@ -0,0 +1,105 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/peachdocs/peach/models"
+)
+
+// CmdMod manages documentation modules imported via MODULES.ini, mirroring
+// the shape of `go mod` / `hugo mod`.
+var CmdMod = cli.Command{
+	Name:  "mod",
+	Usage: "Manage imported documentation modules",
+	Subcommands: []cli.Command{
+		cmdModGet,
+		cmdModGraph,
+		cmdModTidy,
+		cmdModVendor,
+	},
+}
+
+var cmdModGet = cli.Command{
+	Name:      "get",
+	Usage:     "Add or update a module import",
+	ArgsUsage: "<path>@<version>",
+	Action:    runModGet,
+}
+
+func runModGet(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: peach mod get <path>@<version>")
+	}
+
+	arg := ctx.Args()[0]
+	parts := strings.SplitN(arg, "@", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("usage: peach mod get <path>@<version>")
+	}
+
+	if err := models.ModGet(".", parts[0], parts[1]); err != nil {
+		return fmt.Errorf("ModGet: %v", err)
+	}
+	fmt.Printf("added %s %s\n", parts[0], parts[1])
+	return nil
+}
+
+var cmdModGraph = cli.Command{
+	Name:   "graph",
+	Usage:  "Print the resolved module graph",
+	Action: runModGraph,
+}
+
+func runModGraph(ctx *cli.Context) error {
+	lines, err := models.ModGraph(".")
+	if err != nil {
+		return fmt.Errorf("ModGraph: %v", err)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+var cmdModTidy = cli.Command{
+	Name:   "tidy",
+	Usage:  "Resolve imports and rewrite modules.lock",
+	Action: runModTidy,
+}
+
+func runModTidy(ctx *cli.Context) error {
+	if err := models.ModTidy("."); err != nil {
+		return fmt.Errorf("ModTidy: %v", err)
+	}
+	return nil
+}
+
+var cmdModVendor = cli.Command{
+	Name:   "vendor",
+	Usage:  "Fetch every module into data/vendor for offline builds",
+	Action: runModVendor,
+}
+
+func runModVendor(ctx *cli.Context) error {
+	if err := models.ModVendor("."); err != nil {
+		return fmt.Errorf("ModVendor: %v", err)
+	}
+	return nil
+}
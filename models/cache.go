@@ -0,0 +1,150 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cacheKey identifies one cached render: a node's file, pinned to the
+// mtime it was rendered at so an edit invalidates it automatically.
+type cacheKey struct {
+	fileName string
+	mtime    int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	html  []byte
+	text  string
+	bytes int
+}
+
+// contentCache is a size- and memory-aware LRU for rendered Node content,
+// shared by every Toc. Node.Content()/PlainText() fetch through it in both
+// prod and dev mode instead of a Node ever holding its render permanently,
+// so memory use stays bounded no matter how many nodes a site has.
+type contentCache struct {
+	mu sync.Mutex
+
+	maxBytes   int64
+	maxEntries int
+
+	curBytes int64
+	ll       *list.List
+	items    map[cacheKey]*list.Element
+}
+
+func newContentCache(maxBytes int64, maxEntries int) *contentCache {
+	return &contentCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *contentCache) get(key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+func (c *contentCache) put(key cacheKey, html []byte, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, html: html, text: text, bytes: len(html) + len(text)}
+
+	if elem, ok := c.items[key]; ok {
+		c.curBytes -= int64(elem.Value.(*cacheEntry).bytes)
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[key] = c.ll.PushFront(entry)
+	}
+	c.curBytes += int64(entry.bytes)
+
+	for c.curBytes > c.maxBytes || c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		old := oldest.Value.(*cacheEntry)
+		delete(c.items, old.key)
+		c.curBytes -= int64(old.bytes)
+	}
+}
+
+// maxCacheEntries bounds the LRU's entry count independent of its byte
+// budget, so a site with many tiny files can't blow up the map.
+const maxCacheEntries = 100000
+
+const defaultCacheCapacity = 256 << 20 // 256MB, used when /proc/meminfo is unavailable.
+
+// globalContentCache backs every Node.Content()/PlainText() call.
+var globalContentCache = newContentCache(cacheCapacityBytes(), maxCacheEntries)
+
+// cacheCapacityBytes is a quarter of system memory by default, overridable
+// in whole gigabytes via PEACH_MEMORYLIMIT.
+func cacheCapacityBytes() int64 {
+	if gb := os.Getenv("PEACH_MEMORYLIMIT"); len(gb) > 0 {
+		if n, err := strconv.ParseInt(gb, 10, 64); err == nil && n > 0 {
+			return n << 30
+		}
+	}
+
+	total, err := systemMemoryBytes()
+	if err != nil || total == 0 {
+		return defaultCacheCapacity
+	}
+	return total / 4
+}
+
+func systemMemoryBytes() (int64, error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "MemTotal:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("unexpected MemTotal line: %q", line)
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
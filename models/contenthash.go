@@ -0,0 +1,306 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Unknwon/log"
+	"github.com/russross/blackfriday"
+
+	"github.com/peachdocs/peach/modules/setting"
+)
+
+// rendererVersion is mixed into the content hash so bumping the markdown
+// pipeline (e.g. adding a renderer extension) invalidates every cached
+// render instead of serving stale HTML.
+const rendererVersion = "1"
+
+type renderedContent struct {
+	HTML []byte
+	Text string
+}
+
+func contentHash(raw []byte) string {
+	sum := sha256.Sum256(append([]byte(rendererVersion), raw...))
+	return hex.EncodeToString(sum[:])
+}
+
+func renderCachePath(hash string) string {
+	return path.Join(setting.Docs.CacheDir, hash[:2], hash+".json")
+}
+
+func loadCachedRender(hash string) (*renderedContent, bool) {
+	data, err := ioutil.ReadFile(renderCachePath(hash))
+	if err != nil {
+		return nil, false
+	}
+	var rc renderedContent
+	if err = json.Unmarshal(data, &rc); err != nil {
+		return nil, false
+	}
+	return &rc, true
+}
+
+func storeCachedRender(hash string, rc *renderedContent) {
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return
+	}
+	p := renderCachePath(hash)
+	_ = os.MkdirAll(filepath.Dir(p), 0755)
+	_ = ioutil.WriteFile(p, data, 0644)
+}
+
+// renderMarkdown renders raw through the persistent content-addressable
+// cache, keyed by sha256(rendererVersion + raw). Repeated ReloadDocs runs
+// (e.g. after a git pull that only touched a few files) skip blackfriday
+// entirely for every unchanged file.
+func renderMarkdown(raw []byte) (html []byte, text string, hash string) {
+	hash = contentHash(raw)
+	if cached, ok := loadCachedRender(hash); ok {
+		return cached.HTML, cached.Text, hash
+	}
+
+	html = markdown(raw)
+	text = string(bytes.ToLower(blackfriday.Markdown(raw, textRender, 0)))
+	storeCachedRender(hash, &renderedContent{HTML: html, Text: text})
+	return html, text, hash
+}
+
+// trieNode is one node of an immutable trie, one node per path segment,
+// mapping cleaned absolute file paths to content hashes. subtreeHash summarizes
+// every descendant leaf so two trees can be compared for equality without
+// visiting subtrees that didn't change.
+type trieNode struct {
+	leafHash    string
+	children    map[string]*trieNode
+	subtreeHash string
+}
+
+func newPathTrie() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+// insert returns a new trie with segments -> hash set, sharing every
+// untouched subtree with the receiver.
+func (n *trieNode) insert(segments []string, hash string) *trieNode {
+	clone := &trieNode{leafHash: n.leafHash, children: make(map[string]*trieNode, len(n.children))}
+	for name, child := range n.children {
+		clone.children[name] = child
+	}
+
+	if len(segments) == 0 {
+		clone.leafHash = hash
+	} else {
+		child, ok := clone.children[segments[0]]
+		if !ok {
+			child = newPathTrie()
+		}
+		clone.children[segments[0]] = child.insert(segments[1:], hash)
+	}
+
+	clone.subtreeHash = clone.computeSubtreeHash()
+	return clone
+}
+
+func (n *trieNode) computeSubtreeHash() string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(n.leafHash))
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte(n.children[name].subtreeHash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// diffPaths appends every leaf path whose hash differs between old and cur
+// to out, descending only into subtrees whose hash actually changed.
+func diffPaths(old, cur *trieNode, prefix string, out *[]string) {
+	if old != nil && cur != nil && old.subtreeHash == cur.subtreeHash {
+		return
+	}
+
+	oldLeaf, curLeaf := "", ""
+	if old != nil {
+		oldLeaf = old.leafHash
+	}
+	if cur != nil {
+		curLeaf = cur.leafHash
+	}
+	if oldLeaf != curLeaf && (oldLeaf != "" || curLeaf != "") {
+		*out = append(*out, prefix)
+	}
+
+	names := make(map[string]bool)
+	if old != nil {
+		for name := range old.children {
+			names[name] = true
+		}
+	}
+	if cur != nil {
+		for name := range cur.children {
+			names[name] = true
+		}
+	}
+
+	for name := range names {
+		var oldChild, curChild *trieNode
+		if old != nil {
+			oldChild = old.children[name]
+		}
+		if cur != nil {
+			curChild = cur.children[name]
+		}
+		diffPaths(oldChild, curChild, path.Join(prefix, name), out)
+	}
+}
+
+// renderTree is the immutable snapshot built by the most recent ReloadDocs,
+// guarded by tocLocker like everything else it's derived from.
+var renderTree *trieNode
+
+func absPath(fileName string) string {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return fileName
+	}
+	return filepath.ToSlash(abs)
+}
+
+// walkNodes invokes fn for every node reachable from tocs: dir nodes, file
+// nodes, and single pages.
+func walkNodes(tocs map[string]*Toc, fn func(n *Node)) {
+	for _, toc := range tocs {
+		for _, dirNode := range toc.Nodes {
+			fn(dirNode)
+			for _, child := range dirNode.Nodes {
+				fn(child)
+			}
+		}
+		for _, page := range toc.Pages {
+			fn(page)
+		}
+	}
+}
+
+func buildRenderTree(tocs map[string]*Toc) *trieNode {
+	tree := newPathTrie()
+	walkNodes(tocs, func(n *Node) {
+		if n.hash == "" {
+			return
+		}
+		tree = tree.insert(strings.Split(absPath(n.FileName), "/"), n.hash)
+	})
+	return tree
+}
+
+// reloadNodesIncremental populates every node in tocs. On a cold start
+// (prev is nil) it just calls ReloadContent on each. On a warm reload it
+// hashes each file first and, for a file whose hash matches the node at the
+// same path in prev, copies that node's already-parsed metadata instead of
+// re-parsing front matter and re-rendering — so a `git pull` that only
+// touched a few files only pays the ReloadContent cost for those files.
+func reloadNodesIncremental(tocs, prev map[string]*Toc) {
+	var prevByPath map[string]*Node
+	if prev != nil {
+		prevByPath = make(map[string]*Node)
+		walkNodes(prev, func(n *Node) {
+			prevByPath[absPath(n.FileName)] = n
+		})
+	}
+
+	walkNodes(tocs, func(n *Node) {
+		if old, ok := prevByPath[absPath(n.FileName)]; ok && old.hash != "" {
+			if data, err := ioutil.ReadFile(n.FileName); err == nil && contentHash(data) == old.hash {
+				copyNodeMetadata(n, old)
+				return
+			}
+		}
+		if err := n.ReloadContent(); err != nil {
+			log.Error("Fail to reload %s: %v", n.FileName, err)
+		}
+	})
+}
+
+// copyNodeMetadata copies old's parsed front matter and content hash onto
+// n, for a file reloadNodesIncremental has determined is unchanged.
+func copyNodeMetadata(n, old *Node) {
+	n.Title = old.Title
+	n.hash = old.hash
+	n.Plain = old.Plain
+	n.Weight = old.Weight
+	n.Draft = old.Draft
+	n.Tags = old.Tags
+	n.Date = old.Date
+	n.Author = old.Author
+	n.Aliases = old.Aliases
+	n.Params = old.Params
+}
+
+// ReloadChanged re-renders only the nodes whose file is in paths, instead
+// of the full ReloadDocs walk, then rebuilds everything derived from node
+// content: renderTree, every Toc's search index, Aliases, and (in prod
+// mode) draft filtering. It's meant for a future fsnotify watcher to call
+// directly; paths that don't match a known node are ignored.
+func ReloadChanged(paths []string) error {
+	tocLocker.Lock()
+	defer tocLocker.Unlock()
+
+	changed := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		changed[absPath(p)] = true
+	}
+
+	walkNodes(Tocs, func(n *Node) {
+		if !changed[absPath(n.FileName)] {
+			return
+		}
+		if err := n.ReloadContent(); err != nil {
+			log.Error("Fail to reload %s: %v", n.FileName, err)
+		}
+	})
+
+	renderTree = buildRenderTree(Tocs)
+	Aliases = collectAliases(Tocs)
+	if setting.ProdMode {
+		for _, toc := range Tocs {
+			toc.Nodes = withoutDrafts(toc.Nodes)
+			toc.Pages = withoutDrafts(toc.Pages)
+			for _, dirNode := range toc.Nodes {
+				dirNode.Nodes = withoutDrafts(dirNode.Nodes)
+			}
+		}
+	}
+	for _, toc := range Tocs {
+		toc.index = buildSearchIndex(toc)
+	}
+	return nil
+}
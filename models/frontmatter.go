@@ -0,0 +1,184 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// frontMatter is the structured header a page can put before its Markdown
+// body, fenced by "---" (YAML) or "+++" (TOML).
+type frontMatter struct {
+	Name    string                 `yaml:"name" toml:"name"`
+	Weight  int                    `yaml:"weight" toml:"weight"`
+	Draft   bool                   `yaml:"draft" toml:"draft"`
+	Tags    []string               `yaml:"tags" toml:"tags"`
+	Date    time.Time              `yaml:"date" toml:"date"`
+	Author  string                 `yaml:"author" toml:"author"`
+	Aliases []string               `yaml:"aliases" toml:"aliases"`
+	Params  map[string]interface{} `yaml:"params" toml:"params"`
+}
+
+// parseFrontMatter splits data into its front matter and Markdown body. If
+// data has no recognized fence, it returns a frontMatter defaulting Name to
+// name and the data with surrounding whitespace trimmed.
+func parseFrontMatter(name string, data []byte) (*frontMatter, []byte) {
+	data = bytes.TrimSpace(data)
+	fm := &frontMatter{Name: name}
+
+	fence, ok := detectFence(data)
+	if !ok {
+		return fm, data
+	}
+
+	endIdx := bytes.Index(data[len(fence):], fence)
+	if endIdx == -1 {
+		return fm, data
+	}
+	raw := data[len(fence) : len(fence)+endIdx]
+	body := bytes.TrimSpace(data[len(fence)+endIdx+len(fence):])
+
+	var err error
+	if string(fence) == "---" {
+		err = yaml.Unmarshal(raw, fm)
+	} else {
+		_, err = toml.Decode(string(raw), fm)
+	}
+	if err != nil {
+		// Malformed front matter: treat the whole file as plain Markdown
+		// rather than failing the reload of an otherwise-fine doc set.
+		return &frontMatter{Name: name}, data
+	}
+	if len(fm.Name) == 0 {
+		fm.Name = name
+	}
+
+	return fm, body
+}
+
+func detectFence(data []byte) (fence []byte, ok bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte("---")):
+		return []byte("---"), true
+	case bytes.HasPrefix(data, []byte("+++")):
+		return []byte("+++"), true
+	default:
+		return nil, false
+	}
+}
+
+// sortNodesByWeight stable-sorts nodes by Weight ascending, leaving nodes
+// with equal (including zero) Weight in their original TOC.ini order.
+func sortNodesByWeight(nodes []*Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Weight < nodes[j].Weight
+	})
+}
+
+// withoutDrafts returns nodes with every Draft node removed.
+func withoutDrafts(nodes []*Node) []*Node {
+	out := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if !n.Draft {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// Aliases maps a language to its old-URL-path -> canonical-node-path
+// redirects, for the router to register. Aliases don't cross languages, so
+// the same alias can be used independently in each. Rebuilt by every
+// ReloadDocs.
+var Aliases map[string]map[string]string
+
+// collectAliases walks every node of every Toc in tocs (dir nodes, file
+// nodes, and single pages) and maps each of its Aliases to its canonical
+// path, scoped per language.
+func collectAliases(tocs map[string]*Toc) map[string]map[string]string {
+	aliases := make(map[string]map[string]string, len(tocs))
+	for lang, toc := range tocs {
+		langAliases := make(map[string]string)
+
+		for _, dirNode := range toc.Nodes {
+			for _, alias := range dirNode.Aliases {
+				langAliases[alias] = dirNode.Name
+			}
+			for _, child := range dirNode.Nodes {
+				childPath := path.Join(dirNode.Name, child.Name)
+				for _, alias := range child.Aliases {
+					langAliases[alias] = childPath
+				}
+			}
+		}
+
+		for _, page := range toc.Pages {
+			for _, alias := range page.Aliases {
+				langAliases[alias] = page.Name
+			}
+		}
+
+		aliases[lang] = langAliases
+	}
+	return aliases
+}
+
+// ByTag returns every node in t tagged with tag, dir and file nodes alike.
+func (t *Toc) ByTag(tag string) []*Node {
+	var matches []*Node
+	for _, dirNode := range t.Nodes {
+		if hasTag(dirNode.Tags, tag) {
+			matches = append(matches, dirNode)
+		}
+		for _, child := range dirNode.Nodes {
+			if hasTag(child.Tags, tag) {
+				matches = append(matches, child)
+			}
+		}
+	}
+	return matches
+}
+
+// TagCloud returns how many nodes in t carry each tag.
+func (t *Toc) TagCloud() map[string]int {
+	cloud := make(map[string]int)
+	count := func(n *Node) {
+		for _, tag := range n.Tags {
+			cloud[tag]++
+		}
+	}
+	for _, dirNode := range t.Nodes {
+		count(dirNode)
+		for _, child := range dirNode.Nodes {
+			count(child)
+		}
+	}
+	return cloud
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/russross/blackfriday"
+
+	"github.com/peachdocs/peach/modules/setting"
+)
+
+// markdown renders data to HTML via blackfriday, routing fenced code blocks
+// through chromaRenderer for syntax highlighting.
+func markdown(data []byte) []byte {
+	htmlFlags := blackfriday.HTML_USE_XHTML | blackfriday.HTML_USE_SMARTYPANTS
+	renderer := &chromaRenderer{Renderer: blackfriday.HtmlRenderer(htmlFlags, "", "")}
+
+	extensions := blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_AUTOLINK |
+		blackfriday.EXTENSION_STRIKETHROUGH |
+		blackfriday.EXTENSION_SPACE_HEADERS
+
+	return blackfriday.Markdown(data, renderer, extensions)
+}
+
+// chromaRenderer wraps blackfriday's HTML renderer, replacing its BlockCode
+// with a chroma-highlighted one when the fence's language is recognized,
+// and falling back to blackfriday's plain <pre><code> otherwise.
+type chromaRenderer struct {
+	blackfriday.Renderer
+}
+
+func (r *chromaRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+	langName, hlLines := parseCodeLang(lang)
+
+	lexer := lexers.Get(langName)
+	if lexer == nil {
+		r.Renderer.BlockCode(out, text, langName)
+		return
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	style := styles.Get(setting.Docs.Highlight.Style)
+	if style == nil {
+		style = styles.Fallback
+	}
+
+	formatter := html.New(
+		html.WithClasses(),
+		html.TabWidth(setting.Docs.Highlight.TabWidth),
+		html.WithLineNumbers(setting.Docs.Highlight.LineNumbers),
+		html.HighlightLines(hlLines),
+	)
+
+	iterator, err := lexer.Tokenise(nil, string(text))
+	if err != nil {
+		r.Renderer.BlockCode(out, text, langName)
+		return
+	}
+
+	// Render into a scratch buffer first: formatter.Format can fail after
+	// already writing partial output, and writing straight to out would
+	// leave that partial output in place ahead of the plain fallback below.
+	var buf bytes.Buffer
+	if err = formatter.Format(&buf, style, iterator); err != nil {
+		r.Renderer.BlockCode(out, text, langName)
+		return
+	}
+	out.Write(buf.Bytes())
+}
+
+// hlLinesRe pulls the "hl_lines=[3,5-7]" option out of a fence's info
+// string, e.g. "go {hl_lines=[3,5-7]}".
+var hlLinesRe = regexp.MustCompile(`hl_lines=\[([\d,\-\s]*)\]`)
+
+func parseCodeLang(lang string) (name string, hlLines [][2]int) {
+	name = lang
+	idx := strings.Index(lang, "{")
+	if idx == -1 {
+		return name, nil
+	}
+
+	name = strings.TrimSpace(lang[:idx])
+	if m := hlLinesRe.FindStringSubmatch(lang[idx:]); m != nil {
+		hlLines = parseLineRanges(m[1])
+	}
+	return name, hlLines
+}
+
+func parseLineRanges(spec string) [][2]int {
+	var ranges [][2]int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			continue
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			if e, err := strconv.Atoi(strings.TrimSpace(bounds[1])); err == nil {
+				end = e
+			}
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+var chromaCSS string
+
+// GenerateChromaCSS renders the CSS for the configured chroma style once at
+// startup, so ChromaCSS can serve it at /css/chroma.css without redoing the
+// work on every request.
+func GenerateChromaCSS() error {
+	style := styles.Get(setting.Docs.Highlight.Style)
+	if style == nil {
+		style = styles.Fallback
+	}
+
+	var buf bytes.Buffer
+	if err := html.New(html.WithClasses()).WriteCSS(&buf, style); err != nil {
+		return fmt.Errorf("Fail to generate chroma CSS: %v", err)
+	}
+	chromaCSS = buf.String()
+	return nil
+}
+
+// ChromaCSS returns the CSS generated by GenerateChromaCSS.
+func ChromaCSS() string {
+	return chromaCSS
+}
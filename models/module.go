@@ -0,0 +1,413 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Unknwon/com"
+	"gopkg.in/ini.v1"
+)
+
+// Import describes one entry of MODULES.ini: an upstream doc source pinned
+// to a semver tag and merged into the parent TOC under Mounts.
+type Import struct {
+	Path    string // e.g. github.com/foo/api-docs
+	Version string // semver tag, e.g. v1.4.0
+	Mounts  map[string]string // source dir (relative to module root) -> mount point in parent TOC
+}
+
+func (imp *Import) localPath() string {
+	return path.Join("data/modules", imp.Path+"@"+imp.Version)
+}
+
+// parseSemver splits a "v1.4.0"-style tag into comparable integers. Pre-release
+// and build metadata are ignored, which is good enough for minimum-version
+// selection over doc modules.
+func parseSemver(v string) ([3]int, error) {
+	var out [3]int
+	v = strings.TrimPrefix(v, "v")
+	v = strings.SplitN(v, "-", 2)[0]
+	v = strings.SplitN(v, "+", 2)[0]
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) != 3 {
+		return out, fmt.Errorf("not a semver: %q", v)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return out, fmt.Errorf("not a semver: %q", v)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// semverLess reports whether a < b.
+func semverLess(a, b string) bool {
+	av, aerr := parseSemver(a)
+	bv, berr := parseSemver(b)
+	if aerr != nil || berr != nil {
+		return a < b
+	}
+	for i := 0; i < 3; i++ {
+		if av[i] != bv[i] {
+			return av[i] < bv[i]
+		}
+	}
+	return false
+}
+
+// loadModuleImports reads the [module "..."] sections of MODULES.ini under
+// root; [module] sections in app.ini are not read. A site with no
+// MODULES.ini returns an empty, non-nil slice.
+func loadModuleImports(root string) ([]*Import, error) {
+	manifest := path.Join(root, "MODULES.ini")
+	if !com.IsFile(manifest) {
+		return []*Import{}, nil
+	}
+
+	cfg, err := ini.Load(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to load MODULES.ini: %v", err)
+	}
+
+	imports := make([]*Import, 0, len(cfg.Sections()))
+	for _, sec := range cfg.Sections() {
+		if !strings.HasPrefix(sec.Name(), "module ") {
+			continue
+		}
+		imp := &Import{
+			Path:    strings.Trim(strings.TrimPrefix(sec.Name(), "module "), `"`),
+			Version: sec.Key("version").String(),
+			Mounts:  make(map[string]string),
+		}
+		for _, key := range sec.Key("mount").StringsWithShadows(",") {
+			parts := strings.SplitN(key, "=>", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			imp.Mounts[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		imports = append(imports, imp)
+	}
+	return imports, nil
+}
+
+// resolveModules applies minimum-version selection across imports: when the
+// same module path is required at more than one version, the highest of the
+// required minimums wins, and the union of every Mounts entry ends up on
+// the winner.
+func resolveModules(imports []*Import) []*Import {
+	byPath := make(map[string]*Import, len(imports))
+	order := make([]string, 0, len(imports))
+	for _, imp := range imports {
+		cur, ok := byPath[imp.Path]
+		if !ok {
+			byPath[imp.Path] = imp
+			order = append(order, imp.Path)
+			continue
+		}
+
+		winner := cur
+		if semverLess(cur.Version, imp.Version) {
+			winner = imp
+		}
+		for src, dest := range cur.Mounts {
+			winner.Mounts[src] = dest
+		}
+		for src, dest := range imp.Mounts {
+			winner.Mounts[src] = dest
+		}
+		byPath[imp.Path] = winner
+	}
+
+	sort.Strings(order)
+	resolved := make([]*Import, 0, len(order))
+	for _, p := range order {
+		resolved = append(resolved, byPath[p])
+	}
+	return resolved
+}
+
+// resolveModuleTag resolves version against repoURL's tags: an exact tag
+// match wins, otherwise the highest tag whose semver's major component
+// matches version's is used, so a shorthand like "v1" or "v1.4" resolves to
+// the newest matching release. It errors rather than letting an unresolved
+// version silently clone the default branch.
+func resolveModuleTag(repoURL, version string) (string, error) {
+	stdout, stderr, err := com.ExecCmd("git", "ls-remote", "--tags", repoURL)
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote --tags %s: %v - %s", repoURL, err, stderr)
+	}
+
+	wantMajor, wantErr := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0])
+
+	best := ""
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		tag := strings.TrimSuffix(strings.TrimPrefix(fields[1], "refs/tags/"), "^{}")
+		if tag == version {
+			return tag, nil
+		}
+
+		v, err := parseSemver(tag)
+		if err != nil || wantErr != nil || v[0] != wantMajor {
+			continue
+		}
+		if best == "" || semverLess(best, tag) {
+			best = tag
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("no tag matching %q found in %s", version, repoURL)
+	}
+	return best, nil
+}
+
+// fetchModule ensures imp is checked out at its pinned version under
+// data/modules/ and returns the local path, cloning it if that directory does
+// not exist yet. Since the directory name includes the version, an existing
+// checkout is returned as-is, without a fetch or pull.
+func fetchModule(imp *Import) (string, error) {
+	localPath := imp.localPath()
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", fmt.Errorf("filepath.Abs: %v", err)
+	}
+
+	if com.IsDir(absPath) {
+		return absPath, nil
+	}
+
+	repoURL := "https://" + imp.Path + ".git"
+	tag, err := resolveModuleTag(repoURL, imp.Version)
+	if err != nil {
+		return "", fmt.Errorf("Fail to resolve module %s@%s: %v", imp.Path, imp.Version, err)
+	}
+
+	if _, stderr, err := com.ExecCmd("git", "clone", "--branch", tag, "--depth", "1",
+		repoURL, absPath); err != nil {
+		return "", fmt.Errorf("Fail to clone module %s@%s: %v - %s", imp.Path, imp.Version, err, stderr)
+	}
+
+	return absPath, nil
+}
+
+// mergeModule loads imp's own TOC.ini and splices its dir nodes into parent
+// under imp's configured mount points, so a top-level TOC can compose pages
+// from several upstream repos.
+func mergeModule(parent *Toc, imp *Import) error {
+	modRoot, err := fetchModule(imp)
+	if err != nil {
+		return err
+	}
+
+	modTocs, err := initToc(modRoot)
+	if err != nil {
+		return fmt.Errorf("initToc(%s): %v", imp.Path, err)
+	}
+
+	modToc, ok := modTocs[parent.Lang]
+	if !ok {
+		return nil
+	}
+
+	for _, dirNode := range modToc.Nodes {
+		dest, ok := imp.Mounts[dirNode.Name]
+		if !ok {
+			continue
+		}
+		dirNode.Name = dest
+		dirNode.FileName = overlayFileName(dirNode.FileName,
+			path.Join(parent.RootPath, parent.Lang, dest, path.Base(dirNode.FileName)))
+		for _, child := range dirNode.Nodes {
+			child.FileName = overlayFileName(child.FileName,
+				path.Join(parent.RootPath, parent.Lang, dest, child.Name)+".md")
+		}
+		parent.Nodes = append(parent.Nodes, dirNode)
+	}
+	return nil
+}
+
+// applyModules resolves and merges every module import configured for the
+// site into every language's Toc. It is a no-op when no MODULES.ini exists.
+func applyModules(tocs map[string]*Toc, root string) error {
+	imports, err := loadModuleImports(root)
+	if err != nil {
+		return err
+	}
+	if len(imports) == 0 {
+		return nil
+	}
+
+	for _, imp := range resolveModules(imports) {
+		for _, toc := range tocs {
+			if err := mergeModule(toc, imp); err != nil {
+				return fmt.Errorf("mergeModule(%s): %v", imp.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// overlayFileName returns localOverride if it exists on disk, otherwise
+// fileName unchanged. mergeModule resolves module nodes through this so a downstream site
+// can override a single page from an imported module by placing a
+// same-named .md file under its own docs root.
+func overlayFileName(fileName, localOverride string) string {
+	if localOverride != fileName && com.IsFile(localOverride) {
+		return localOverride
+	}
+	return fileName
+}
+
+// saveModuleImports writes imports back to root/MODULES.ini, one [module
+// "path"] section per import, so a resolved version sticks across restarts
+// instead of living only in modules.lock.
+func saveModuleImports(root string, imports []*Import) error {
+	cfg := ini.Empty()
+	for _, imp := range imports {
+		sec, err := cfg.NewSection(fmt.Sprintf("module %q", imp.Path))
+		if err != nil {
+			return err
+		}
+		if _, err = sec.NewKey("version", imp.Version); err != nil {
+			return err
+		}
+
+		if len(imp.Mounts) > 0 {
+			mounts := make([]string, 0, len(imp.Mounts))
+			for src, dest := range imp.Mounts {
+				mounts = append(mounts, src+" => "+dest)
+			}
+			sort.Strings(mounts)
+			if _, err = sec.NewKey("mount", strings.Join(mounts, ", ")); err != nil {
+				return err
+			}
+		}
+	}
+	return cfg.SaveTo(path.Join(root, "MODULES.ini"))
+}
+
+const lockFile = "modules.lock"
+
+// writeModulesLock writes the resolved import set to root/modules.lock, one
+// "path version" pair per line, so `peach mod get`/`tidy` runs are
+// reproducible.
+func writeModulesLock(root string, imports []*Import) error {
+	lines := make([]string, len(imports))
+	for i, imp := range imports {
+		lines[i] = imp.Path + " " + imp.Version
+	}
+	sort.Strings(lines)
+	return ioutil.WriteFile(path.Join(root, lockFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// ModGet adds or updates an import in MODULES.ini to modPath@version, fetches
+// it, and rewrites modules.lock. It is the model backing `peach mod get`.
+func ModGet(root, modPath, version string) error {
+	imports, err := loadModuleImports(root)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, imp := range imports {
+		if imp.Path == modPath {
+			imp.Version = version
+			found = true
+		}
+	}
+	if !found {
+		imports = append(imports, &Import{Path: modPath, Version: version, Mounts: map[string]string{}})
+	}
+
+	resolved := resolveModules(imports)
+	for _, imp := range resolved {
+		if _, err := fetchModule(imp); err != nil {
+			return err
+		}
+	}
+
+	if err = saveModuleImports(root, resolved); err != nil {
+		return fmt.Errorf("Fail to save MODULES.ini: %v", err)
+	}
+	return writeModulesLock(root, resolved)
+}
+
+// ModGraph returns a "path version" line per resolved import, for
+// `peach mod graph`.
+func ModGraph(root string) ([]string, error) {
+	imports, err := loadModuleImports(root)
+	if err != nil {
+		return nil, err
+	}
+	resolved := resolveModules(imports)
+	lines := make([]string, len(resolved))
+	for i, imp := range resolved {
+		lines[i] = imp.Path + " " + imp.Version
+	}
+	return lines, nil
+}
+
+// ModTidy re-resolves MODULES.ini (dropping nothing today, since imports
+// aren't transitive yet) and rewrites modules.lock to match.
+func ModTidy(root string) error {
+	imports, err := loadModuleImports(root)
+	if err != nil {
+		return err
+	}
+	return writeModulesLock(root, resolveModules(imports))
+}
+
+// ModVendor fetches every resolved import and copies it under
+// root/data/vendor/<path>@<version>. fetchModule does not read from
+// data/vendor: loading modules always uses the checkouts under data/modules/.
+func ModVendor(root string) error {
+	imports, err := loadModuleImports(root)
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range resolveModules(imports) {
+		modRoot, err := fetchModule(imp)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(root, "data/vendor", imp.Path+"@"+imp.Version)
+		if err = os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("Fail to clear vendor dir for %s@%s: %v", imp.Path, imp.Version, err)
+		}
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("Fail to create vendor dir for %s@%s: %v", imp.Path, imp.Version, err)
+		}
+		if _, stderr, err := com.ExecCmd("cp", "-r", modRoot, dest); err != nil {
+			return fmt.Errorf("Fail to vendor module %s@%s: %v - %s", imp.Path, imp.Version, err, stderr)
+		}
+	}
+	return nil
+}
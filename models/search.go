@@ -0,0 +1,433 @@
+// Copyright 2015 Unknwon
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package models
+
+import (
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 tuning parameters, see Robertson & Zaragoza's "The Probabilistic
+// Relevance Framework" for the usual defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Range marks a highlighted span (byte offsets) within a SearchResult's
+// Match text.
+type Range struct {
+	Start int
+	End   int
+}
+
+// wordRe is the tokenizer: any run of Unicode letters or digits is a term.
+// It is intentionally simple and word-oriented; a run of CJK characters
+// becomes one token, so a query for a single CJK word embedded in a longer
+// run won't match against it. isCJKQuery routes that case to trigramSearch
+// instead, which matches substrings directly.
+var wordRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+func tokenize(text string) []string {
+	return wordRe.FindAllString(text, -1)
+}
+
+// isCJK reports whether r belongs to a script wordRe's word-run tokenizer
+// can't usefully split: Han, Hiragana, Katakana, or Hangul.
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+// isCJKQuery reports whether q is made entirely of CJK runes (ignoring
+// any whitespace) and thus should be answered by trigramSearch
+// rather than the term index.
+func isCJKQuery(q string) bool {
+	found := false
+	for _, r := range q {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if !isCJK(r) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// cjkTrigrams returns the set of 3-rune windows of text whose runes are all
+// CJK, used to build and query the trigram index.
+func cjkTrigrams(text string) map[string]bool {
+	runes := []rune(text)
+	set := make(map[string]bool)
+	for i := 0; i+3 <= len(runes); i++ {
+		if isCJK(runes[i]) && isCJK(runes[i+1]) && isCJK(runes[i+2]) {
+			set[string(runes[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// posting records, for a single term, which positions (word index, not byte
+// offset) it occurs at within one node's Text.
+type posting struct {
+	nodeID    int
+	positions []int
+}
+
+// searchIndex is the in-memory inverted index backing Toc.Search for a
+// single language. It is rebuilt from scratch by buildSearchIndex whenever
+// ReloadDocs runs and swapped into Toc.index under tocLocker.
+type searchIndex struct {
+	nodes     []*Node  // nodeID -> node
+	paths     []string // nodeID -> display path, as returned in SearchResult.Path
+	text      []string // nodeID -> plaintext, snapshotted at build time for snippetAround
+	postings  map[string][]*posting
+	trigrams  map[string]map[int]bool // CJK trigram -> set of nodeIDs containing it, for trigramSearch
+	docLen    []int                   // nodeID -> term count
+	avgDocLen float64
+}
+
+// buildSearchIndex fetches every node's plaintext through globalContentCache
+// (rendering and inserting on miss), tokenizes it, and builds a term ->
+// posting list index for t. Dir nodes and file nodes are indexed alike,
+// matching the set of nodes the old linear Search used to scan.
+func buildSearchIndex(t *Toc) *searchIndex {
+	idx := &searchIndex{
+		postings: make(map[string][]*posting),
+		trigrams: make(map[string]map[int]bool),
+		text:     make([]string, 0, len(t.Nodes)),
+	}
+
+	add := func(n *Node, p string) {
+		id := len(idx.nodes)
+		idx.nodes = append(idx.nodes, n)
+		idx.paths = append(idx.paths, p)
+
+		text := n.PlainText()
+		idx.text = append(idx.text, text)
+
+		terms := tokenize(text)
+		idx.docLen = append(idx.docLen, len(terms))
+
+		seen := make(map[string]*posting, len(terms))
+		for pos, term := range terms {
+			post, ok := seen[term]
+			if !ok {
+				post = &posting{nodeID: id}
+				seen[term] = post
+				idx.postings[term] = append(idx.postings[term], post)
+			}
+			post.positions = append(post.positions, pos)
+		}
+
+		for tri := range cjkTrigrams(text) {
+			if idx.trigrams[tri] == nil {
+				idx.trigrams[tri] = make(map[int]bool)
+			}
+			idx.trigrams[tri][id] = true
+		}
+	}
+
+	for i := range t.Nodes {
+		add(t.Nodes[i], t.Nodes[i].Name)
+		for j := range t.Nodes[i].Nodes {
+			add(t.Nodes[i].Nodes[j], path.Join(t.Nodes[i].Name, t.Nodes[i].Nodes[j].Name))
+		}
+	}
+
+	var total int
+	for _, l := range idx.docLen {
+		total += l
+	}
+	if len(idx.docLen) > 0 {
+		idx.avgDocLen = float64(total) / float64(len(idx.docLen))
+	}
+
+	return idx
+}
+
+// searchQuery is a parsed query string: every entry in required must match
+// (a len-1 entry is a single term, a longer entry is an ordered phrase),
+// and no entry in negated may appear.
+type searchQuery struct {
+	required [][]string
+	negated  []string
+}
+
+func parseQuery(q string) *searchQuery {
+	sq := &searchQuery{}
+	q = strings.ToLower(strings.TrimSpace(q))
+
+	for len(q) > 0 {
+		switch {
+		case strings.HasPrefix(q, `"`):
+			end := strings.Index(q[1:], `"`)
+			if end == -1 {
+				if terms := tokenize(q[1:]); len(terms) > 0 {
+					sq.required = append(sq.required, terms)
+				}
+				q = ""
+				continue
+			}
+			if terms := tokenize(q[1 : end+1]); len(terms) > 0 {
+				sq.required = append(sq.required, terms)
+			}
+			q = strings.TrimSpace(q[end+2:])
+
+		case strings.HasPrefix(q, "-"):
+			term, rest := splitToken(q[1:])
+			if term != "" {
+				sq.negated = append(sq.negated, term)
+			}
+			q = strings.TrimSpace(rest)
+
+		default:
+			term, rest := splitToken(q)
+			if term != "" {
+				sq.required = append(sq.required, []string{term})
+			}
+			q = strings.TrimSpace(rest)
+		}
+	}
+
+	return sq
+}
+
+func splitToken(s string) (token, rest string) {
+	if i := strings.IndexAny(s, " \t"); i > -1 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+func findPosting(posts []*posting, nodeID int) *posting {
+	for _, p := range posts {
+		if p.nodeID == nodeID {
+			return p
+		}
+	}
+	return nil
+}
+
+func hasPosition(positions []int, pos int) bool {
+	for _, p := range positions {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// phraseMatches returns the starting word-positions within nodeID at which
+// phrase occurs verbatim (adjacent positions for every word in it). For a
+// single-word phrase it's just that term's positions.
+func (idx *searchIndex) phraseMatches(nodeID int, phrase []string) []int {
+	lead := findPosting(idx.postings[phrase[0]], nodeID)
+	if lead == nil {
+		return nil
+	}
+	if len(phrase) == 1 {
+		return lead.positions
+	}
+
+	matches := make([]int, 0, len(lead.positions))
+	for _, start := range lead.positions {
+		ok := true
+		for k := 1; k < len(phrase); k++ {
+			post := findPosting(idx.postings[phrase[k]], nodeID)
+			if post == nil || !hasPosition(post.positions, start+k) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matches = append(matches, start)
+		}
+	}
+	return matches
+}
+
+// search scores every candidate node with BM25 over its matched phrases and
+// returns hits ordered by descending score.
+func (idx *searchIndex) search(q string) []*SearchResult {
+	if isCJKQuery(q) {
+		return idx.trigramSearch(q)
+	}
+
+	sq := parseQuery(q)
+	if len(sq.required) == 0 {
+		return nil
+	}
+
+	candidates := idx.candidateSet(sq.required[0][0])
+	for _, phrase := range sq.required[1:] {
+		set := idx.candidateSet(phrase[0])
+		for id := range candidates {
+			if !set[id] {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	n := float64(len(idx.nodes))
+	type scored struct {
+		id       int
+		score    float64
+		startTok int
+		endTok   int
+	}
+	hits := make([]scored, 0, len(candidates))
+
+scanCandidates:
+	for id := range candidates {
+		for _, neg := range sq.negated {
+			if findPosting(idx.postings[neg], id) != nil {
+				continue scanCandidates
+			}
+		}
+
+		var score float64
+		startTok, endTok := -1, -1
+		for _, phrase := range sq.required {
+			positions := idx.phraseMatches(id, phrase)
+			if len(positions) == 0 {
+				continue scanCandidates
+			}
+
+			df := float64(len(idx.postings[phrase[0]]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			tf := float64(len(positions))
+			dl := float64(idx.docLen[id])
+			score += idf * (tf * (bm25K1 + 1)) / (tf + bm25K1*(1-bm25B+bm25B*dl/idx.avgDocLen))
+
+			if startTok == -1 {
+				startTok, endTok = positions[0], positions[0]+len(phrase)
+			}
+		}
+
+		hits = append(hits, scored{id: id, score: score, startTok: startTok, endTok: endTok})
+	}
+
+	sort.Slice(hits, func(a, b int) bool { return hits[a].score > hits[b].score })
+
+	results := make([]*SearchResult, 0, len(hits))
+	for _, h := range hits {
+		snippet, highlights := snippetAround(idx.text[h.id], h.startTok, h.endTok)
+		results = append(results, &SearchResult{
+			Title:      idx.nodes[h.id].Title,
+			Path:       idx.paths[h.id],
+			Match:      snippet,
+			Highlights: highlights,
+		})
+	}
+	return results
+}
+
+// trigramSearch answers a CJK query the term index can't: it narrows to
+// candidate nodes via the trigram index (or, for a query under 3 runes,
+// every indexed node, since trigrams can't help), then confirms and locates
+// the real substring match against each candidate's cached plaintext.
+func (idx *searchIndex) trigramSearch(q string) []*SearchResult {
+	q = strings.ToLower(strings.TrimSpace(q))
+	runes := []rune(q)
+
+	var candidates map[int]bool
+	if len(runes) < 3 {
+		candidates = make(map[int]bool, len(idx.nodes))
+		for id := range idx.nodes {
+			candidates[id] = true
+		}
+	} else {
+		for i := 0; i+3 <= len(runes); i++ {
+			set := idx.trigrams[string(runes[i:i+3])]
+			if i == 0 {
+				candidates = make(map[int]bool, len(set))
+				for id := range set {
+					candidates[id] = true
+				}
+				continue
+			}
+			for id := range candidates {
+				if !set[id] {
+					delete(candidates, id)
+				}
+			}
+		}
+	}
+
+	results := make([]*SearchResult, 0, len(candidates))
+	for id := range candidates {
+		text := idx.text[id]
+		byteIdx := strings.Index(text, q)
+		if byteIdx == -1 {
+			continue
+		}
+		snipStart, snipEnd := adjustRange(byteIdx, byteIdx+len(q), len(text))
+		results = append(results, &SearchResult{
+			Title: idx.nodes[id].Title,
+			Path:  idx.paths[id],
+			Match: text[snipStart:snipEnd],
+			Highlights: []Range{
+				{Start: byteIdx - snipStart, End: byteIdx + len(q) - snipStart},
+			},
+		})
+	}
+
+	sort.Slice(results, func(a, b int) bool { return results[a].Path < results[b].Path })
+	return results
+}
+
+func (idx *searchIndex) candidateSet(term string) map[int]bool {
+	posts := idx.postings[term]
+	set := make(map[int]bool, len(posts))
+	for _, p := range posts {
+		set[p.nodeID] = true
+	}
+	return set
+}
+
+// snippetAround builds a SearchResult.Match around the word span
+// [startTok, endTok) of text, re-using adjustRange's context window, and
+// translates that span into byte-offset Highlights relative to the snippet.
+func snippetAround(text string, startTok, endTok int) (string, []Range) {
+	locs := wordRe.FindAllStringIndex(text, -1)
+	if startTok < 0 || startTok >= len(locs) {
+		return "", nil
+	}
+	if endTok > len(locs) {
+		endTok = len(locs)
+	}
+
+	spanStart, spanEnd := locs[startTok][0], locs[endTok-1][1]
+	snipStart, snipEnd := adjustRange(spanStart, spanEnd, len(text))
+
+	highlights := make([]Range, 0, endTok-startTok)
+	for i := startTok; i < endTok; i++ {
+		highlights = append(highlights, Range{
+			Start: locs[i][0] - snipStart,
+			End:   locs[i][1] - snipStart,
+		})
+	}
+
+	return text[snipStart:snipEnd], highlights
+}
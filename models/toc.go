@@ -18,85 +18,123 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Unknwon/com"
 	"github.com/Unknwon/log"
 	"github.com/mschoch/blackfriday-text"
-	"github.com/russross/blackfriday"
 	"gopkg.in/ini.v1"
 
 	"github.com/peachdocs/peach/modules/setting"
 )
 
 type Node struct {
-	Name    string // Name in TOC
-	Title   string // Name in given language
-	content []byte
-	Text    string // Clean text without formatting
+	Name  string // Name in TOC
+	Title string // Name in given language
+	hash  string // Content hash of the last render, used by the render tree.
 
 	Plain    bool   // Root node without content
 	FileName string // Full path with .md extension
 	Nodes    []*Node
+
+	Weight  int                    // Overrides TOC.ini order within its parent when non-zero.
+	Draft   bool                   // Excluded from Tocs in prod mode.
+	Tags    []string
+	Date    time.Time
+	Author  string
+	Aliases []string               // Old URLs that should redirect to this node.
+	Params  map[string]interface{} // Arbitrary front matter, exposed to templates.
 }
 
 var textRender = blackfridaytext.TextRenderer()
 
-func parseNodeName(name string, data []byte) (string, []byte) {
-	data = bytes.TrimSpace(data)
-	if len(data) < 3 || string(data[:3]) != "---" {
-		return name, []byte("")
-	}
-	endIdx := bytes.Index(data[3:], []byte("---")) + 3
-	if endIdx == -1 {
-		return name, []byte("")
+// ReloadContent re-reads the node's front matter and, unless it's a plain
+// dir node, its rendered HTML and plaintext. The render itself is never
+// kept on Node: it's pushed straight into globalContentCache, so Content()
+// and PlainText() are the only way to read it back and total memory use
+// stays bounded by the cache regardless of how many Nodes exist.
+func (n *Node) ReloadContent() error {
+	data, err := ioutil.ReadFile(n.FileName)
+	if err != nil {
+		return err
 	}
 
-	opts := strings.Split(strings.TrimSpace(string(string(data[3:endIdx]))), "\n")
-
-	title := name
-	for _, opt := range opts {
-		infos := strings.SplitN(opt, ":", 2)
-		if len(infos) != 2 {
-			continue
-		}
+	fm, body := parseFrontMatter(n.Name, data)
+	n.Title = fm.Name
+	n.Weight = fm.Weight
+	n.Draft = fm.Draft
+	n.Tags = fm.Tags
+	n.Date = fm.Date
+	n.Author = fm.Author
+	n.Aliases = fm.Aliases
+	n.Params = fm.Params
+
+	n.Plain = len(bytes.TrimSpace(body)) == 0
+	if n.Plain {
+		return nil
+	}
 
-		switch strings.TrimSpace(infos[0]) {
-		case "name":
-			title = strings.TrimSpace(infos[1])
-		}
+	fi, err := os.Stat(n.FileName)
+	if err != nil {
+		return err
 	}
 
-	return title, data[endIdx+3:]
+	html, text, _ := renderMarkdown(body)
+	n.hash = contentHash(data)
+	globalContentCache.put(cacheKey{fileName: n.FileName, mtime: fi.ModTime().UnixNano()}, html, text)
+	return nil
 }
 
-func (n *Node) ReloadContent() error {
-	data, err := ioutil.ReadFile(n.FileName)
+// render returns the node's rendered HTML and plaintext, fetched through
+// globalContentCache and keyed on the file's mtime so an unchanged file
+// never re-renders, in prod mode or dev.
+func (n *Node) render() (html []byte, text string, err error) {
+	if n.Plain {
+		return nil, "", nil
+	}
+
+	fi, err := os.Stat(n.FileName)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	n.Title, data = parseNodeName(n.Name, data)
-	n.Plain = len(bytes.TrimSpace(data)) == 0
+	key := cacheKey{fileName: n.FileName, mtime: fi.ModTime().UnixNano()}
+	if entry, ok := globalContentCache.get(key); ok {
+		return entry.html, entry.text, nil
+	}
 
-	if !n.Plain {
-		n.content = markdown(data)
-		n.Text = string(bytes.ToLower(blackfriday.Markdown(data, textRender, 0)))
+	if err = n.ReloadContent(); err != nil {
+		return nil, "", err
 	}
-	return nil
+	if entry, ok := globalContentCache.get(key); ok {
+		return entry.html, entry.text, nil
+	}
+	return nil, "", nil
 }
 
+// Content returns the node's rendered HTML, fetched through
+// globalContentCache.
 func (n *Node) Content() []byte {
-	if !setting.ProdMode {
-		if err := n.ReloadContent(); err != nil {
-			log.Error("Fail to reload content: %v", err)
-		}
+	html, _, err := n.render()
+	if err != nil {
+		log.Error("Fail to render content: %v", err)
 	}
+	return html
+}
 
-	return n.content
+// PlainText returns the node's rendered plaintext, fetched through
+// globalContentCache. Used by the search index builder.
+func (n *Node) PlainText() string {
+	_, text, err := n.render()
+	if err != nil {
+		log.Error("Fail to render content: %v", err)
+	}
+	return text
 }
 
 // Toc represents table of content in a specific language.
@@ -105,6 +143,8 @@ type Toc struct {
 	Lang     string
 	Nodes    []*Node
 	Pages    []*Node
+
+	index *searchIndex // Built by buildSearchIndex in ReloadDocs.
 }
 
 // GetDoc should only be called by top level toc.
@@ -152,10 +192,12 @@ func (t *Toc) GetDoc(name string) (string, []byte, bool) {
 	return "", nil, false
 }
 
+// SearchResult is a single scored hit returned by Toc.Search.
 type SearchResult struct {
-	Title string
-	Path  string
-	Match string
+	Title      string
+	Path       string
+	Match      string
+	Highlights []Range // Byte ranges within Match that matched the query.
 }
 
 func adjustRange(start, end, length int) (int, int) {
@@ -170,41 +212,17 @@ func adjustRange(start, end, length int) (int, int) {
 	return start, end
 }
 
+// Search looks up q against t's inverted index and returns hits ordered by
+// BM25 score. It supports "phrase matches", and -exclusions. A query made
+// entirely of CJK characters is instead answered by the trigram index, so a
+// CJK word embedded in a longer run still matches; those hits are ordered by
+// path rather than by score. See buildSearchIndex for
+// how both indexes are constructed.
 func (t *Toc) Search(q string) []*SearchResult {
-	if len(q) == 0 {
+	if len(q) == 0 || t.index == nil {
 		return nil
 	}
-	q = strings.ToLower(q)
-
-	results := make([]*SearchResult, 0, 5)
-
-	// Dir node.
-	for i := range t.Nodes {
-		if idx := strings.Index(t.Nodes[i].Text, q); idx > -1 {
-			start, end := adjustRange(idx, idx+len(q), len(t.Nodes[i].Text))
-			results = append(results, &SearchResult{
-				Title: t.Nodes[i].Title,
-				Path:  t.Nodes[i].Name,
-				Match: t.Nodes[i].Text[start:end],
-			})
-		}
-	}
-
-	// File node.
-	for i := range t.Nodes {
-		for j := range t.Nodes[i].Nodes {
-			if idx := strings.Index(t.Nodes[i].Nodes[j].Text, q); idx > -1 {
-				start, end := adjustRange(idx, idx+len(q), len(t.Nodes[i].Nodes[j].Text))
-				results = append(results, &SearchResult{
-					Title: t.Nodes[i].Nodes[j].Title,
-					Path:  path.Join(t.Nodes[i].Name, t.Nodes[i].Nodes[j].Name),
-					Match: t.Nodes[i].Nodes[j].Text[start:end],
-				})
-			}
-		}
-	}
-
-	return results
+	return t.index.search(q)
 }
 
 var (
@@ -318,12 +336,47 @@ func ReloadDocs() error {
 	if err != nil {
 		return fmt.Errorf("initToc: %v", err)
 	}
-	initDocs(tocs, localRoot)
+	if err = applyModules(tocs, localRoot); err != nil {
+		return fmt.Errorf("applyModules: %v", err)
+	}
+	reloadNodesIncremental(tocs, Tocs)
+
+	for _, toc := range tocs {
+		sortNodesByWeight(toc.Nodes)
+		for _, dirNode := range toc.Nodes {
+			sortNodesByWeight(dirNode.Nodes)
+		}
+	}
+	Aliases = collectAliases(tocs)
+	if setting.ProdMode {
+		for _, toc := range tocs {
+			toc.Nodes = withoutDrafts(toc.Nodes)
+			toc.Pages = withoutDrafts(toc.Pages)
+			for _, dirNode := range toc.Nodes {
+				dirNode.Nodes = withoutDrafts(dirNode.Nodes)
+			}
+		}
+	}
+
+	newTree := buildRenderTree(tocs)
+	if renderTree != nil {
+		var changed []string
+		diffPaths(renderTree, newTree, "", &changed)
+		log.Trace("ReloadDocs: %d file(s) changed: %v", len(changed), changed)
+	}
+	renderTree = newTree
+
+	for _, toc := range tocs {
+		toc.index = buildSearchIndex(toc)
+	}
 	Tocs = tocs
 	return nil
 }
 
 func NewContext() {
+	if err := GenerateChromaCSS(); err != nil {
+		log.Fatal("Fail to init docs: %v", err)
+	}
 	if err := ReloadDocs(); err != nil {
 		log.Fatal("Fail to init docs: %v", err)
 	}